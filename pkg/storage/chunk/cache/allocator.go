@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"context"
+	"sync"
+)
+
+// Allocator is used to obtain the byte slices that fetched cache values are
+// written into. Implementations may reuse memory across calls (e.g. via a
+// sync.Pool) to avoid letting the memcached client allocate a fresh buffer
+// for every item on the query path.
+type Allocator interface {
+	// Get returns a slice with at least sz capacity.
+	Get(sz int) *[]byte
+	// Put returns a slice previously obtained from Get so it can be reused.
+	Put(b *[]byte)
+}
+
+type allocatorContextKey struct{}
+
+// ContextWithAllocator returns a copy of ctx carrying alloc. Memcached.fetch
+// will use alloc, if present, as the destination for GetMulti instead of
+// letting the memcached client allocate a fresh buffer per item, then Put the
+// buffer back to alloc itself once it has copied the (possibly decompressed)
+// value out of it, so alloc's buffers are always returned and reused
+// regardless of what Fetch's caller does with the returned values. If
+// decompressing a value fails, fetch returns at once and the buffers of that
+// item and of the items after it are not Put back. No caller
+// in this tree attaches an allocator yet; pkg/querier/queryrange, the
+// obvious place to add it, doesn't have a caching middleware in this
+// checkout to attach it to.
+func ContextWithAllocator(ctx context.Context, alloc Allocator) context.Context {
+	return context.WithValue(ctx, allocatorContextKey{}, alloc)
+}
+
+// AllocatorFromContext returns the Allocator attached to ctx by
+// ContextWithAllocator, if any.
+func AllocatorFromContext(ctx context.Context) (Allocator, bool) {
+	alloc, ok := ctx.Value(allocatorContextKey{}).(Allocator)
+	return alloc, ok
+}
+
+// bufferPoolSizeClasses are the buffer sizes offered by BufferPool. A
+// request for sz bytes is satisfied by the smallest class that fits it.
+var bufferPoolSizeClasses = []int{
+	1 << 10,  // 1KiB
+	4 << 10,  // 4KiB
+	16 << 10, // 16KiB
+	64 << 10, // 64KiB
+	256 << 10,
+	1 << 20, // 1MiB
+	4 << 20,
+}
+
+// BufferPool is the default Allocator: a sync.Pool per size class, so
+// buffers can be reused across Fetch calls rather than allocated fresh each
+// time.
+type BufferPool struct {
+	pools []sync.Pool
+}
+
+// NewBufferPool creates a size-classed, sync.Pool-backed Allocator.
+func NewBufferPool() *BufferPool {
+	bp := &BufferPool{pools: make([]sync.Pool, len(bufferPoolSizeClasses))}
+	for i, sz := range bufferPoolSizeClasses {
+		sz := sz
+		bp.pools[i].New = func() interface{} {
+			buf := make([]byte, 0, sz)
+			return &buf
+		}
+	}
+	return bp
+}
+
+// sizeClass returns the index of the smallest size class that fits sz, or -1
+// if sz is larger than every class.
+func (bp *BufferPool) sizeClass(sz int) int {
+	for i, c := range bufferPoolSizeClasses {
+		if sz <= c {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get implements Allocator.
+func (bp *BufferPool) Get(sz int) *[]byte {
+	i := bp.sizeClass(sz)
+	if i < 0 {
+		buf := make([]byte, 0, sz)
+		return &buf
+	}
+	buf := bp.pools[i].Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// Put implements Allocator.
+func (bp *BufferPool) Put(b *[]byte) {
+	if b == nil {
+		return
+	}
+	if i := bp.sizeClass(cap(*b)); i >= 0 && cap(*b) == bufferPoolSizeClasses[i] {
+		bp.pools[i].Put(b)
+	}
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+)
+
+func TestBufferPool_ReusesBuffers(t *testing.T) {
+	bp := NewBufferPool()
+
+	buf := bp.Get(100)
+	if cap(*buf) < 100 {
+		t.Fatalf("expected capacity >= 100, got %d", cap(*buf))
+	}
+	*buf = append(*buf, []byte("hello")...)
+	bp.Put(buf)
+
+	buf2 := bp.Get(100)
+	if len(*buf2) != 0 {
+		t.Fatalf("expected a reset buffer, got len %d", len(*buf2))
+	}
+}
+
+// benchBatchSize mimics a batched Fetch: every buffer in the batch is
+// obtained up front and held while the batch's results are assembled, then
+// returned together at the end. Getting and Putting a single buffer back to
+// back, in the same iteration, would let every Get reuse that one buffer and
+// hide the pool's actual allocation behavior under realistic, overlapping
+// use.
+const benchBatchSize = 16
+
+func BenchmarkBufferPool_Get(b *testing.B) {
+	bp := NewBufferPool()
+	bufs := make([]*[]byte, benchBatchSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := range bufs {
+			bufs[j] = bp.Get(64 << 10)
+		}
+		for _, buf := range bufs {
+			*buf = append(*buf, make([]byte, 64<<10)...)
+		}
+		for _, buf := range bufs {
+			bp.Put(buf)
+		}
+	}
+}
+
+func BenchmarkBufferPool_GetNoPool(b *testing.B) {
+	bufs := make([][]byte, benchBatchSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := range bufs {
+			bufs[j] = make([]byte, 64<<10)
+		}
+	}
+}
+
+// allocatingMockMemcache fills the Item.Value it returns from GetMulti using
+// alloc, when set, the same way a real allocator-aware memcached client
+// would fill its read buffer from the Allocator passed via
+// memcache.WithAllocator; when alloc is nil it allocates a fresh buffer per
+// call instead, modeling GetMulti with no allocator attached. It exists
+// because memcache.Option has no exported way to recover the allocator it
+// carries outside of the real client, so this stands in for that client in
+// the benchmarks below.
+type allocatingMockMemcache struct {
+	alloc Allocator
+	value []byte
+}
+
+func (m *allocatingMockMemcache) GetMulti(keys []string, _ ...memcache.Option) (map[string]*memcache.Item, error) {
+	items := make(map[string]*memcache.Item, len(keys))
+	for _, k := range keys {
+		var value []byte
+		if m.alloc != nil {
+			buf := m.alloc.Get(len(m.value))
+			*buf = append((*buf)[:0], m.value...)
+			value = *buf
+		} else {
+			value = append([]byte(nil), m.value...)
+		}
+		items[k] = &memcache.Item{Key: k, Value: value}
+	}
+	return items, nil
+}
+
+func (m *allocatingMockMemcache) Set(item *memcache.Item) error { return nil }
+
+// benchFetchKeysBatched runs Memcached.fetchKeysBatched against
+// benchBatchSize keys, per b.N, optionally attaching alloc to the context.
+func benchFetchKeysBatched(b *testing.B, alloc Allocator) {
+	value := bytes.Repeat([]byte("loki-allocator-bench"), 200)
+	client := &allocatingMockMemcache{value: value}
+	if alloc != nil {
+		client.alloc = alloc
+	}
+
+	c := NewMemcached(MemcachedConfig{BatchSize: benchBatchSize, Parallelism: 4}, client, "bench", prometheus.NewRegistry(), log.NewNopLogger(), stats.CacheType("bench"))
+
+	keys := make([]string, benchBatchSize)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	ctx := context.Background()
+	if alloc != nil {
+		ctx = ContextWithAllocator(ctx, alloc)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := c.fetchKeysBatched(ctx, keys); err != nil {
+			b.Fatalf("fetchKeysBatched: %v", err)
+		}
+	}
+}
+
+// BenchmarkMemcached_FetchKeysBatched_WithAllocator and
+// BenchmarkMemcached_FetchKeysBatched_NoAllocator compare a large batched
+// Fetch with and without a per-call allocator. With one attached, GetMulti's
+// read buffers come from (and are returned to) alloc, but fetch copies every
+// value out of its alloc buffer into a freshly allocated slice before
+// returning it, so allocs/op are not lower than without an allocator.
+func BenchmarkMemcached_FetchKeysBatched_WithAllocator(b *testing.B) {
+	benchFetchKeysBatched(b, NewBufferPool())
+}
+
+func BenchmarkMemcached_FetchKeysBatched_NoAllocator(b *testing.B) {
+	benchFetchKeysBatched(b, nil)
+}
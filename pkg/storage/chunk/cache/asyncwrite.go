@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log/level"
+	instr "github.com/grafana/dskit/instrument"
+	"github.com/grafana/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/loki/pkg/util/constants"
+)
+
+// asyncWriteBatchSize bounds how many queued writes a single writer
+// goroutine takes off the queue as one batch before updating metrics and
+// picking the next item off the queue.
+const asyncWriteBatchSize = 64
+
+// writeItem is a single queued write, waiting to be issued to memcached by
+// one of the async writer goroutines.
+type writeItem struct {
+	key        string
+	value      []byte
+	expiration int32
+
+	// compressedBuf, if non-nil, is the compressionPool buffer backing
+	// value; it must be returned to the pool once the write completes.
+	compressedBuf *[]byte
+}
+
+// startAsyncWriters allocates the write queue and its metrics, and launches
+// cfg.WriteConcurrency writer goroutines draining it.
+func (c *Memcached) startAsyncWriters(name string, reg prometheus.Registerer) {
+	queueSize := c.cfg.WriteQueueSize
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	concurrency := c.cfg.WriteConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	c.writeCh = make(chan writeItem, queueSize)
+	c.stopped = make(chan struct{})
+
+	constLabels := prometheus.Labels{"name": name}
+	c.asyncDropped = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Namespace:   constants.Loki,
+		Name:        "memcache_async_dropped_total",
+		Help:        "Total number of async writes dropped because the write queue was full.",
+		ConstLabels: constLabels,
+	})
+	c.queueLength = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Namespace:   constants.Loki,
+		Name:        "memcache_async_queue_length",
+		Help:        "Number of writes currently queued for async writing to memcached.",
+		ConstLabels: constLabels,
+	})
+	c.inflightBatches = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Namespace:   constants.Loki,
+		Name:        "memcache_async_inflight_batches",
+		Help:        "Number of batches of queued writes currently being issued to memcached.",
+		ConstLabels: constLabels,
+	})
+
+	c.writeWG.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go c.runAsyncWriter()
+	}
+}
+
+// storeAsync enqueues keys/bufs for writing by the async writer goroutines
+// and returns immediately. If the queue is full, items that don't fit are
+// dropped and counted rather than blocking the caller. It holds sendWG for
+// its duration so stopAsyncWriters can't close writeCh out from under a send
+// that's already in progress; once stopped is closed, no new sends are
+// attempted at all.
+func (c *Memcached) storeAsync(keys []string, bufs [][]byte) error {
+	c.sendWG.Add(1)
+	defer c.sendWG.Done()
+
+	select {
+	case <-c.stopped:
+		c.asyncDropped.Add(float64(len(keys)))
+		return nil
+	default:
+	}
+
+	var err error
+	for i := range keys {
+		value, compressed, compressErr := c.compressValue(bufs[i])
+		if compressErr != nil {
+			err = compressErr
+			continue
+		}
+
+		item := writeItem{
+			key:           keys[i],
+			value:         value,
+			expiration:    int32(c.cfg.Expiration.Seconds()),
+			compressedBuf: compressed,
+		}
+
+		select {
+		case c.writeCh <- item:
+		default:
+			c.asyncDropped.Inc()
+			if compressed != nil {
+				c.compressionPool.Put(compressed)
+			}
+		}
+	}
+	c.queueLength.Set(float64(len(c.writeCh)))
+	return err
+}
+
+// runAsyncWriter drains writeCh, taking up to asyncWriteBatchSize
+// consecutive items as one batch before reporting back to the gauges. The
+// items of a batch are written with one Set call each, one after another;
+// they are not pipelined into a single request.
+func (c *Memcached) runAsyncWriter() {
+	defer c.writeWG.Done()
+
+	for first, ok := <-c.writeCh; ok; first, ok = <-c.writeCh {
+		batch := make([]writeItem, 0, asyncWriteBatchSize)
+		batch = append(batch, first)
+
+	drain:
+		for len(batch) < asyncWriteBatchSize {
+			select {
+			case item, ok := <-c.writeCh:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, item)
+			default:
+				break drain
+			}
+		}
+
+		c.inflightBatches.Inc()
+		for _, item := range batch {
+			cacheErr := instr.CollectedRequest(context.Background(), "Memcache.Put", c.requestDuration, memcacheStatusCode, func(_ context.Context) error {
+				return c.memcache.Set(&memcache.Item{
+					Key:        item.key,
+					Value:      item.value,
+					Expiration: item.expiration,
+				})
+			})
+			if item.compressedBuf != nil {
+				c.compressionPool.Put(item.compressedBuf)
+			}
+			if cacheErr != nil {
+				level.Warn(c.logger).Log("msg", "async memcached write failed", "key", item.key, "err", cacheErr)
+			}
+		}
+		c.inflightBatches.Dec()
+		c.queueLength.Set(float64(len(c.writeCh)))
+	}
+}
+
+// stopAsyncWriters signals storeAsync to stop accepting new writes, closes
+// the write queue once any in-flight storeAsync calls have finished sending,
+// and waits up to cfg.WriteFlushTimeout for the writer goroutines to drain
+// it. It is guarded by stopOnce so repeated or concurrent calls are safe.
+func (c *Memcached) stopAsyncWriters() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+		// Wait for any storeAsync call already past its stopped check to
+		// finish sending before we close writeCh, otherwise it could send
+		// on (or panic sending on) a closed channel.
+		c.sendWG.Wait()
+		close(c.writeCh)
+
+		done := make(chan struct{})
+		go func() {
+			c.writeWG.Wait()
+			close(done)
+		}()
+
+		timeout := c.cfg.WriteFlushTimeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			level.Warn(c.logger).Log("msg", "timed out waiting for async memcached writes to drain", "timeout", timeout)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/pkg/util/constants"
+)
+
+// Compression is the algorithm used to compress values before storing them in
+// memcached.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionS2   Compression = "s2"
+	CompressionZstd Compression = "zstd"
+)
+
+// magicS2 and magicZstd prefix a value stored with a particular Compression
+// algorithm, so that Fetch can tell compressed items from plain ones (and
+// which algorithm was used) without needing to know the config that wrote
+// them. The final byte identifies the algorithm.
+var (
+	magicS2   = []byte("\x00LK1s")
+	magicZstd = []byte("\x00LK1z")
+)
+
+var errUnknownCompression = errors.New("cache: unknown compression magic prefix")
+
+// compressionValue adapts a *Compression to flag.Value so it can be
+// registered directly against a flag.FlagSet.
+type compressionValue struct {
+	c *Compression
+}
+
+func newCompressionValue(c *Compression) *compressionValue {
+	*c = CompressionNone
+	return &compressionValue{c: c}
+}
+
+func (v *compressionValue) String() string {
+	if v.c == nil {
+		return string(CompressionNone)
+	}
+	return string(*v.c)
+}
+
+func (v *compressionValue) Set(s string) error {
+	switch Compression(s) {
+	case CompressionNone, CompressionS2, CompressionZstd:
+		*v.c = Compression(s)
+		return nil
+	default:
+		return errors.Errorf("cache: unsupported compression %q, must be one of none, s2, zstd", s)
+	}
+}
+
+// compressionMetrics are the histograms recorded by the compression layer,
+// shared across Store/Fetch calls for a single Memcached instance. It also
+// holds the long-lived zstd encoder/decoder used by compress/maybeDecompress,
+// so a fresh one (with its own internal goroutines) isn't spun up on every
+// call; both are safe for concurrent use by multiple goroutines.
+type compressionMetrics struct {
+	ratio   prometheus.Observer
+	cpuTime *prometheus.HistogramVec
+
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+}
+
+func newCompressionMetrics(name string, cacheType stats.CacheType, reg prometheus.Registerer) *compressionMetrics {
+	constLabels := prometheus.Labels{"name": name, "cache_type": string(cacheType)}
+
+	ratio := promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Namespace:   constants.Loki,
+		Name:        "memcache_compression_ratio",
+		Help:        "Ratio of compressed to uncompressed size for values written to memcached (lower is better).",
+		Buckets:     prometheus.LinearBuckets(0.1, 0.1, 10),
+		ConstLabels: constLabels,
+	})
+
+	cpuTime := promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   constants.Loki,
+		Name:        "memcache_compression_cpu_seconds",
+		Help:        "CPU time spent compressing or decompressing values for memcached, per op.",
+		Buckets:     prometheus.DefBuckets,
+		ConstLabels: constLabels,
+	}, []string{"op"})
+
+	// NewWriter/NewReader only fail on invalid options; we pass none, so
+	// these errors are unreachable.
+	enc, _ := zstd.NewWriter(nil)
+	dec, _ := zstd.NewReader(nil)
+
+	return &compressionMetrics{ratio: ratio, cpuTime: cpuTime, zstdEncoder: enc, zstdDecoder: dec}
+}
+
+// compress encodes value using algo, returning a buffer obtained from pool.
+// The returned buffer is prefixed with the algorithm's magic and owned by the
+// caller, who must Put it back to pool once done with it. The pool buffer is
+// used directly as the encoder's destination so encoding doesn't also
+// allocate its own output buffer.
+func compress(algo Compression, value []byte, pool Allocator, metrics *compressionMetrics) (*[]byte, error) {
+	start := time.Now()
+
+	var out *[]byte
+	switch algo {
+	case CompressionS2:
+		out = pool.Get(len(magicS2) + s2.MaxEncodedLen(len(value)))
+		dst := (*out)[:cap(*out)]
+		copy(dst, magicS2)
+		encoded := s2.Encode(dst[len(magicS2):], value)
+		*out = dst[:len(magicS2)+len(encoded)]
+	case CompressionZstd:
+		out = pool.Get(len(magicZstd) + len(value))
+		*out = append((*out)[:0], magicZstd...)
+		*out = metrics.zstdEncoder.EncodeAll(value, *out)
+	default:
+		return nil, errors.Errorf("cache: unsupported compression %q", algo)
+	}
+
+	metrics.cpuTime.WithLabelValues("compress").Observe(time.Since(start).Seconds())
+	if len(value) > 0 {
+		metrics.ratio.Observe(float64(len(*out)) / float64(len(value)))
+	}
+
+	return out, nil
+}
+
+// maybeDecompress returns value as-is (and a nil buf) if it doesn't carry a
+// known compression magic prefix, or its decompressed contents otherwise. In
+// the latter case buf is the pool buffer backing the returned bytes, which
+// the caller must Put back once it has copied or otherwise finished with
+// them; as with compress, that buffer is used directly as the decoder's
+// destination to avoid a second copy during decoding itself.
+func maybeDecompress(value []byte, pool Allocator, metrics *compressionMetrics) (out []byte, buf *[]byte, err error) {
+	algo, ok := sniffCompression(value)
+	if !ok {
+		return value, nil, nil
+	}
+
+	start := time.Now()
+	payload := value[len(magicS2):] // magicS2 and magicZstd share the same length.
+
+	switch algo {
+	case CompressionS2:
+		sz, err := s2.DecodedLen(payload)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "s2 decompressing value")
+		}
+		buf = pool.Get(sz)
+		decoded, err := s2.Decode((*buf)[:cap(*buf)], payload)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "s2 decompressing value")
+		}
+		*buf = decoded
+	case CompressionZstd:
+		buf = pool.Get(zstdDecodedLen(payload))
+		decoded, err := metrics.zstdDecoder.DecodeAll(payload, (*buf)[:0])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "zstd decompressing value")
+		}
+		*buf = decoded
+	default:
+		return nil, nil, errUnknownCompression
+	}
+
+	metrics.cpuTime.WithLabelValues("decompress").Observe(time.Since(start).Seconds())
+
+	return *buf, buf, nil
+}
+
+// zstdDecodedLen returns the size of the decoded content of a zstd frame
+// produced by compress, read from the frame header that EncodeAll always
+// records when the full input is known upfront (as it is here). It falls
+// back to a conservative multiple of the compressed length on the off chance
+// the header doesn't carry one, so pool.Get is always sized for the decoded
+// output rather than the (typically much smaller) compressed payload.
+func zstdDecodedLen(payload []byte) int {
+	var header zstd.Header
+	if err := header.Decode(payload); err == nil && header.FrameContentSize > 0 {
+		return int(header.FrameContentSize)
+	}
+	return len(payload) * 3
+}
+
+func sniffCompression(value []byte) (Compression, bool) {
+	switch {
+	case bytes.HasPrefix(value, magicS2):
+		return CompressionS2, true
+	case bytes.HasPrefix(value, magicZstd):
+		return CompressionZstd, true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+)
+
+func TestCompressDecompress_RoundTrip(t *testing.T) {
+	for _, algo := range []Compression{CompressionS2, CompressionZstd} {
+		t.Run(string(algo), func(t *testing.T) {
+			pool := NewBufferPool()
+			metrics := newCompressionMetrics("test", stats.CacheType("test"), prometheus.NewRegistry())
+
+			value := bytes.Repeat([]byte("loki-compression-test"), 100)
+
+			compressed, err := compress(algo, value, pool, metrics)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+
+			decompressed, buf, err := maybeDecompress(*compressed, pool, metrics)
+			if err != nil {
+				t.Fatalf("maybeDecompress: %v", err)
+			}
+			if buf == nil {
+				t.Fatalf("expected a pool buffer for a compressed value")
+			}
+
+			if !bytes.Equal(decompressed, value) {
+				t.Fatalf("round trip mismatch: got %d bytes, want %d bytes", len(decompressed), len(value))
+			}
+		})
+	}
+}
+
+func TestMaybeDecompress_PassesThroughUncompressed(t *testing.T) {
+	pool := NewBufferPool()
+	metrics := newCompressionMetrics("test", stats.CacheType("test"), prometheus.NewRegistry())
+
+	value := []byte("plain value")
+	out, buf, err := maybeDecompress(value, pool, metrics)
+	if err != nil {
+		t.Fatalf("maybeDecompress: %v", err)
+	}
+	if !bytes.Equal(out, value) {
+		t.Fatalf("expected uncompressed value to pass through unchanged, got %q", out)
+	}
+	if buf != nil {
+		t.Fatalf("expected no pool buffer for a passthrough value")
+	}
+}
@@ -11,18 +11,20 @@ import (
 	"github.com/go-kit/log"
 	instr "github.com/grafana/dskit/instrument"
 	"github.com/grafana/gomemcache/memcache"
-	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/grafana/loki/pkg/logqlmodel/stats"
 	"github.com/grafana/loki/pkg/util/constants"
 	"github.com/grafana/loki/pkg/util/math"
 )
 
-var (
-	ErrMemcachedStoppedByClient = errors.New("cache is stopped by client")
-)
+// MemcachedClient is a client for accessing memcached.
+type MemcachedClient interface {
+	GetMulti(keys []string, opts ...memcache.Option) (map[string]*memcache.Item, error)
+	Set(item *memcache.Item) error
+}
 
 // MemcachedConfig is config to make a Memcached
 type MemcachedConfig struct {
@@ -30,6 +32,16 @@ type MemcachedConfig struct {
 
 	BatchSize   int `yaml:"batch_size"`
 	Parallelism int `yaml:"parallelism"`
+
+	SingleFlight bool `yaml:"singleflight"`
+
+	Compression  Compression `yaml:"compression"`
+	MinSizeBytes int         `yaml:"min_size_bytes"`
+
+	AsyncWrites       bool          `yaml:"async_writes"`
+	WriteQueueSize    int           `yaml:"write_queue_size"`
+	WriteConcurrency  int           `yaml:"write_concurrency"`
+	WriteFlushTimeout time.Duration `yaml:"write_flush_timeout"`
 }
 
 // RegisterFlagsWithPrefix adds the flags required to config this to the given FlagSet
@@ -37,6 +49,13 @@ func (cfg *MemcachedConfig) RegisterFlagsWithPrefix(prefix, description string,
 	f.DurationVar(&cfg.Expiration, prefix+"memcached.expiration", 0, description+"How long keys stay in the memcache.")
 	f.IntVar(&cfg.BatchSize, prefix+"memcached.batchsize", 256, description+"How many keys to fetch in each batch.")
 	f.IntVar(&cfg.Parallelism, prefix+"memcached.parallelism", 10, description+"Maximum active requests to memcache.")
+	f.BoolVar(&cfg.SingleFlight, prefix+"memcached.singleflight", false, description+"Coalesce concurrent Fetch calls that overlap on the same key into a single backend request.")
+	f.Var(newCompressionValue(&cfg.Compression), prefix+"memcached.compression", description+"Compress values before storing them in memcached. Valid values: none, s2, zstd.")
+	f.IntVar(&cfg.MinSizeBytes, prefix+"memcached.min-size-bytes", 0, description+"Only compress values at least this many bytes long; ignored when compression is \"none\".")
+	f.BoolVar(&cfg.AsyncWrites, prefix+"memcached.async-writes", false, description+"Write to memcached asynchronously, returning from Store before the write completes.")
+	f.IntVar(&cfg.WriteQueueSize, prefix+"memcached.write-queue-size", 1000, description+"Maximum number of writes that can be queued when async writes are enabled. Writes are dropped once the queue is full.")
+	f.IntVar(&cfg.WriteConcurrency, prefix+"memcached.write-concurrency", 4, description+"Number of goroutines issuing queued writes to memcached when async writes are enabled.")
+	f.DurationVar(&cfg.WriteFlushTimeout, prefix+"memcached.write-flush-timeout", 5*time.Second, description+"How long Stop() waits for the async write queue to drain before shutting down writers.")
 }
 
 // Memcached type caches chunks in memcached
@@ -48,18 +67,35 @@ type Memcached struct {
 
 	requestDuration *instr.HistogramCollector
 
-	wg      sync.WaitGroup
-	inputCh chan *work
-
-	// `closed` tracks if `inputCh` is closed.
-	// So that any writer goroutine wouldn't write to it after closing `intputCh`
-	closed chan struct{}
-
-	// stopped track if `inputCh` and `closed` chan need to closed. Reason being,
-	// there are two entry points that can close these channels, when client calls
-	// .Stop() explicitly, or passed context is cancelled.
-	// So `Stop()` will make sure it's not closing the channels that are already closed, which may cause a panic.
-	stopped sync.Once
+	// gate bounds the number of batches that may be in flight against
+	// memcached at once. A batch acquires a slot before issuing its
+	// GetMulti and releases it when done.
+	gate chan struct{}
+
+	// sf de-duplicates concurrent Fetch calls that overlap on the same key,
+	// when cfg.SingleFlight is enabled.
+	sf *singleFlightGroup
+
+	// compressionPool and compressionMetrics back Store/fetch's transparent
+	// compression, when cfg.Compression is not CompressionNone.
+	compressionPool    *BufferPool
+	compressionMetrics *compressionMetrics
+
+	// writeCh and writeWG back the async write-behind Store path, when
+	// cfg.AsyncWrites is enabled. stopped is closed (once, via stopOnce)
+	// before writeCh is closed, so storeAsync can check it instead of racing
+	// a send against the close of writeCh itself; sendWG is held by every
+	// storeAsync call in flight, and stopAsyncWriters waits on it after
+	// closing stopped but before closing writeCh, so no send can still be
+	// in progress once writeCh is closed. See asyncwrite.go.
+	writeCh         chan writeItem
+	writeWG         sync.WaitGroup
+	sendWG          sync.WaitGroup
+	stopped         chan struct{}
+	stopOnce        sync.Once
+	asyncDropped    prometheus.Counter
+	queueLength     prometheus.Gauge
+	inflightBatches prometheus.Gauge
 
 	logger log.Logger
 
@@ -90,51 +126,28 @@ func NewMemcached(cfg MemcachedConfig, client MemcachedClient, name string, reg
 				ConstLabels: prometheus.Labels{"name": name},
 			}, []string{"method", "status_code"}),
 		),
-		closed: make(chan struct{}),
 	}
 
-	if cfg.BatchSize == 0 || cfg.Parallelism == 0 {
-		return c
+	if cfg.SingleFlight {
+		c.sf = newSingleFlightGroup(name, reg)
 	}
 
-	c.inputCh = make(chan *work)
-	c.wg.Add(cfg.Parallelism)
-
-	for i := 0; i < cfg.Parallelism; i++ {
-		go func() {
-			defer c.wg.Done()
-			for input := range c.inputCh {
-				res := &result{
-					batchID: input.batchID,
-				}
-				res.found, res.bufs, res.missed, res.err = c.fetch(input.ctx, input.keys)
-				// NOTE: This check is needed because goroutines submitting work via `inputCh` may exit in-between because of context cancellation or timeout. This helps to close these worker goroutines to exit without hanging around.
-				select {
-				case <-c.closed:
-					return
-				case input.resultCh <- res:
-				}
-			}
+	if cfg.Compression != CompressionNone && cfg.Compression != "" {
+		c.compressionPool = NewBufferPool()
+		c.compressionMetrics = newCompressionMetrics(name, cacheType, reg)
+	}
 
-		}()
+	if cfg.AsyncWrites {
+		c.startAsyncWriters(name, reg)
 	}
 
-	return c
-}
+	if cfg.BatchSize == 0 || cfg.Parallelism == 0 {
+		return c
+	}
 
-type work struct {
-	keys     []string
-	ctx      context.Context
-	resultCh chan<- *result
-	batchID  int // For ordering results.
-}
+	c.gate = make(chan struct{}, cfg.Parallelism)
 
-type result struct {
-	found   []string
-	bufs    [][]byte
-	missed  []string
-	err     error
-	batchID int // For ordering results.
+	return c
 }
 
 func memcacheStatusCode(err error) string {
@@ -153,6 +166,14 @@ func memcacheStatusCode(err error) string {
 
 // Fetch gets keys from the cache. The keys that are found must be in the order of the keys requested.
 func (c *Memcached) Fetch(ctx context.Context, keys []string) (found []string, bufs [][]byte, missed []string, err error) {
+	if c.sf != nil {
+		return c.sf.fetch(ctx, keys, c.fetchBackend)
+	}
+	return c.fetchBackend(ctx, keys)
+}
+
+// fetchBackend issues the actual GetMulti(s) against memcached, batching if configured.
+func (c *Memcached) fetchBackend(ctx context.Context, keys []string) (found []string, bufs [][]byte, missed []string, err error) {
 	if c.cfg.BatchSize == 0 {
 		found, bufs, missed, err = c.fetch(ctx, keys)
 		return
@@ -168,8 +189,13 @@ func (c *Memcached) fetch(ctx context.Context, keys []string) (found []string, b
 	var (
 		start = time.Now()
 		items map[string]*memcache.Item
+		opts  []memcache.Option
 	)
-	items, err = c.memcache.GetMulti(keys)
+	alloc, hasAlloc := AllocatorFromContext(ctx)
+	if hasAlloc {
+		opts = append(opts, memcache.WithAllocator(alloc))
+	}
+	items, err = c.memcache.GetMulti(keys, opts...)
 	c.requestDuration.After(ctx, "Memcache.GetMulti", memcacheStatusCode(err), start)
 	if err != nil {
 		return found, bufs, keys, err
@@ -177,99 +203,153 @@ func (c *Memcached) fetch(ctx context.Context, keys []string) (found []string, b
 
 	for _, key := range keys {
 		item, ok := items[key]
-		if ok {
-			found = append(found, key)
-			bufs = append(bufs, item.Value)
-		} else {
+		if !ok {
 			missed = append(missed, key)
+			continue
+		}
+
+		// raw is alloc-owned when hasAlloc (GetMulti filled it via
+		// memcache.WithAllocator above); value may become a second,
+		// compressionPool-owned buffer below.
+		raw := item.Value
+		value := raw
+		var decompressBuf *[]byte
+		if c.compressionPool != nil {
+			value, decompressBuf, err = maybeDecompress(raw, c.compressionPool, c.compressionMetrics)
+			if err != nil {
+				return found, bufs, missed, err
+			}
+		}
+
+		// value only needs reclaiming into a plain, unpooled slice when it
+		// (or raw) actually came from a pool: fetch has no way to know when
+		// its caller is done with a pool/alloc buffer to Put it back later
+		// (there's no such caller in this tree yet, see
+		// ContextWithAllocator), so those have to be copied out and
+		// returned right away. Plain GetMulti output with no allocator and
+		// no compression is already a value nobody else owns and needs no
+		// extra copy.
+		if hasAlloc || decompressBuf != nil {
+			out := append([]byte(nil), value...)
+			if decompressBuf != nil {
+				c.compressionPool.Put(decompressBuf)
+			}
+			if hasAlloc {
+				alloc.Put(&raw)
+			}
+			value = out
 		}
+
+		found = append(found, key)
+		bufs = append(bufs, value)
 	}
 	return
 }
 
-func (c *Memcached) fetchKeysBatched(ctx context.Context, keys []string) (found []string, bufs [][]byte, missed []string, err error) {
-	resultsCh := make(chan *result)
-	var workerErr error // any error (timeout, context cancel) happened in worker go routine that we start in this method?
+// doWithBatch splits [0, totalSize) into batches of batchSize and calls fn on
+// each one concurrently, under an errgroup.Group. Before issuing its work,
+// each batch acquires a slot from gate, a bounded concurrency gate; if ctx is
+// cancelled before a batch acquires a slot, that batch never runs. fn is
+// expected to write its results into slices indexed by batch position, so
+// callers don't need any extra bookkeeping to preserve key ordering.
+func doWithBatch(ctx context.Context, totalSize, batchSize int, gate chan struct{}, fn func(ctx context.Context, start, end int) error) error {
+	if totalSize == 0 {
+		return nil
+	}
+	if batchSize == 0 {
+		return fn(ctx, 0, totalSize)
+	}
 
-	batchSize := c.cfg.BatchSize
+	g, ctx := errgroup.WithContext(ctx)
+	for start := 0; start < totalSize; start += batchSize {
+		start := start
+		end := math.Min(start+batchSize, totalSize)
+		g.Go(func() error {
+			// Check explicitly rather than relying on select's
+			// pseudo-random case choice: if both ctx.Done() and gate
+			// are ready at once, select may still pick gate and let a
+			// cancelled batch run.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 
-	go func() {
-		for i, j := 0, 0; i < len(keys); i += batchSize {
-			batchKeys := keys[i:math.Min(i+batchSize, len(keys))]
 			select {
 			case <-ctx.Done():
-				c.closeAndStop()
-				workerErr = ctx.Err()
-				return
-			case <-c.closed:
-				workerErr = ErrMemcachedStoppedByClient
-				return
-			default:
-				if c.testFetchDelay != nil {
-					<-c.testFetchDelay
-				}
-
-				c.inputCh <- &work{
-					keys:     batchKeys,
-					ctx:      ctx,
-					resultCh: resultsCh,
-					batchID:  j,
-				}
-
-				j++
+				return ctx.Err()
+			case gate <- struct{}{}:
 			}
-		}
-	}()
+			defer func() { <-gate }()
 
-	// Read all values from this channel to avoid blocking upstream.
-	numResults := len(keys) / batchSize
-	if len(keys)%batchSize != 0 {
-		numResults++
+			return fn(ctx, start, end)
+		})
 	}
+	return g.Wait()
+}
 
-	// We need to order found by the input keys order.
-	results := make([]*result, numResults)
-	for i := 0; i < numResults; i++ {
-		// NOTE: Without this check, <-resultCh may wait forever as work is
-		// interrupted (by other goroutine by calling `Stop()`) and there may not be `numResults`
-		// values to read from `resultsCh` in that case.
-		// Also we do close(resultsCh) in the same goroutine so <-resultCh may never return.
-		select {
-		case <-c.closed:
-			if workerErr != nil {
-				err = workerErr
-			}
-			return
-		case result := <-resultsCh:
-			results[result.batchID] = result
-		}
+func (c *Memcached) fetchKeysBatched(ctx context.Context, keys []string) (found []string, bufs [][]byte, missed []string, err error) {
+	batchSize := c.cfg.BatchSize
+
+	numBatches := len(keys) / batchSize
+	if len(keys)%batchSize != 0 {
+		numBatches++
 	}
-	close(resultsCh)
-
-	for _, result := range results {
-		found = append(found, result.found...)
-		bufs = append(bufs, result.bufs...)
-		missed = append(missed, result.missed...)
-		if result.err != nil {
-			err = result.err
+
+	batchFound := make([][]string, numBatches)
+	batchBufs := make([][][]byte, numBatches)
+	batchMissed := make([][]string, numBatches)
+
+	err = doWithBatch(ctx, len(keys), batchSize, c.gate, func(ctx context.Context, start, end int) error {
+		if c.testFetchDelay != nil {
+			<-c.testFetchDelay
 		}
+
+		batchID := start / batchSize
+		f, b, m, batchErr := c.fetch(ctx, keys[start:end])
+		batchFound[batchID] = f
+		batchBufs[batchID] = b
+		batchMissed[batchID] = m
+		return batchErr
+	})
+
+	for i := range batchFound {
+		found = append(found, batchFound[i]...)
+		bufs = append(bufs, batchBufs[i]...)
+		missed = append(missed, batchMissed[i]...)
 	}
 
 	return
 }
 
-// Store stores the key in the cache.
+// Store stores the key in the cache. By default this blocks until every key
+// has been written; if cfg.AsyncWrites is enabled it instead queues the
+// writes and returns immediately, see asyncwrite.go.
 func (c *Memcached) Store(ctx context.Context, keys []string, bufs [][]byte) error {
+	if c.writeCh != nil {
+		return c.storeAsync(keys, bufs)
+	}
+	return c.storeSync(ctx, keys, bufs)
+}
+
+func (c *Memcached) storeSync(ctx context.Context, keys []string, bufs [][]byte) error {
 	var err error
 	for i := range keys {
+		value, compressed, compressErr := c.compressValue(bufs[i])
+		if compressErr != nil {
+			err = compressErr
+			continue
+		}
+
 		cacheErr := instr.CollectedRequest(ctx, "Memcache.Put", c.requestDuration, memcacheStatusCode, func(_ context.Context) error {
 			item := memcache.Item{
 				Key:        keys[i],
-				Value:      bufs[i],
+				Value:      value,
 				Expiration: int32(c.cfg.Expiration.Seconds()),
 			}
 			return c.memcache.Set(&item)
 		})
+		if compressed != nil {
+			c.compressionPool.Put(compressed)
+		}
 		if cacheErr != nil {
 			err = cacheErr
 		}
@@ -277,22 +357,28 @@ func (c *Memcached) Store(ctx context.Context, keys []string, bufs [][]byte) err
 	return err
 }
 
-func (c *Memcached) Stop() {
-	if c.inputCh == nil {
-		return
+// compressValue compresses value if compression is enabled and value is long
+// enough to meet cfg.MinSizeBytes, returning the bytes to store and,
+// if they came from compressionPool, the buffer to Put back once the caller
+// is done with them.
+func (c *Memcached) compressValue(value []byte) (out []byte, buf *[]byte, err error) {
+	if c.compressionPool == nil || len(value) < c.cfg.MinSizeBytes {
+		return value, nil, nil
+	}
+	buf, err = compress(c.cfg.Compression, value, c.compressionPool, c.compressionMetrics)
+	if err != nil {
+		return nil, nil, err
 	}
-	c.closeAndStop()
-	c.wg.Wait()
+	return *buf, buf, nil
 }
 
-// closeAndStop closes the `inputCh`, `closed` channel and update the `stopped` flag to true.
-// Assumes c.inputCh, c.closed channels are non-nil
-// Go routine safe and idempotent.
-func (c *Memcached) closeAndStop() {
-	c.stopped.Do(func() {
-		close(c.inputCh)
-		close(c.closed)
-	})
+// Stop shuts the cache down, draining the async write queue first if
+// cfg.AsyncWrites is enabled.
+func (c *Memcached) Stop() {
+	if c.writeCh == nil {
+		return
+	}
+	c.stopAsyncWriters()
 }
 
 func (c *Memcached) GetCacheType() stats.CacheType {
@@ -301,7 +387,7 @@ func (c *Memcached) GetCacheType() stats.CacheType {
 
 // Warning: SetTestFetchDelay should be used only for testing.
 // To introduce artifical delay between each batch fetch.
-// Helpful to test if each batch is respecting the `ctx` cancelled or `Stop()` called
+// Helpful to test if each batch is respecting the `ctx` cancelled
 // in-between each batch
 // NOTE: It is exported method instead of internal method because,
 // test's uses `cache.SetTestFetchDelay` due to some cyclic dependencies in this package
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+)
+
+// countingMemcache is a minimal MemcachedClient that finds every key,
+// counting how many GetMulti calls (i.e. batches) actually ran.
+type countingMemcache struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (m *countingMemcache) GetMulti(keys []string, _ ...memcache.Option) (map[string]*memcache.Item, error) {
+	m.mu.Lock()
+	m.calls++
+	m.mu.Unlock()
+
+	items := make(map[string]*memcache.Item, len(keys))
+	for _, k := range keys {
+		items[k] = &memcache.Item{Key: k, Value: []byte("v")}
+	}
+	return items, nil
+}
+
+func (m *countingMemcache) Set(item *memcache.Item) error { return nil }
+
+// TestMemcached_FetchKeysBatched_CancelMidBatch covers the cancel-before-
+// gate-acquire path added by the 34061aa fix commit: with Parallelism 1,
+// only one batch can ever hold the gate at a time, so cancelling once that
+// batch is in flight must stop every other, still-queued batch from running
+// its GetMulti at all, and fetchKeysBatched must return ctx.Err() promptly
+// rather than waiting for them.
+func TestMemcached_FetchKeysBatched_CancelMidBatch(t *testing.T) {
+	client := &countingMemcache{}
+	cfg := MemcachedConfig{BatchSize: 1, Parallelism: 1}
+	c := NewMemcached(cfg, client, "test", prometheus.NewRegistry(), log.NewNopLogger(), stats.CacheType("test"))
+
+	delay := make(chan struct{})
+	c.SetTestFetchDelay(delay)
+
+	keys := []string{"a", "b", "c", "d"}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		_, _, _, err = c.fetchKeysBatched(ctx, keys)
+	}()
+
+	// Wait for exactly one batch to acquire the gate (and block on
+	// testFetchDelay before calling GetMulti) before cancelling: the other
+	// 3 batches are still queued on the gate's select and must never reach
+	// GetMulti.
+	for len(c.gate) != cap(c.gate) {
+		runtime.Gosched()
+	}
+	cancel()
+	delay <- struct{}{}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fetchKeysBatched did not return promptly after cancellation")
+	}
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.calls != 1 {
+		t.Fatalf("expected exactly 1 batch to have called GetMulti before cancellation, got %d", client.calls)
+	}
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/loki/pkg/util/constants"
+)
+
+// fetchFunc issues the real GetMulti(s) against memcached for a set of keys.
+// It has the same signature as Memcached.fetch/fetchKeysBatched.
+type fetchFunc func(ctx context.Context, keys []string) (found []string, bufs [][]byte, missed []string, err error)
+
+// inflight is a single in-flight backend request for one key. id is a
+// generation counter: the owner goroutine deletes the entry under its key in
+// singleFlightGroup.entries only if that entry still carries its id, so a
+// newer entry under the same key would be left alone. Entries are removed
+// only by their owner, once its backend request returns; nothing cancels or
+// expires an entry before that.
+type inflight struct {
+	id   uint64
+	done chan struct{}
+
+	buf   []byte
+	found bool
+	err   error
+}
+
+// singleFlightGroup de-duplicates concurrent Memcached.Fetch calls that
+// overlap on the same key: only one goroutine issues the backend request for
+// a given key at a time, and the others wait on its result.
+type singleFlightGroup struct {
+	mu      sync.Mutex
+	nextID  uint64
+	entries map[string]*inflight
+
+	coalesced prometheus.Counter
+}
+
+func newSingleFlightGroup(name string, reg prometheus.Registerer) *singleFlightGroup {
+	return &singleFlightGroup{
+		entries: make(map[string]*inflight),
+		coalesced: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Namespace: constants.Loki,
+			Name:      "memcache_singleflight_coalesced_total",
+			Help:      "Total number of keys in Fetch calls that were served by an in-flight request for the same key instead of issuing a new backend request.",
+			ConstLabels: prometheus.Labels{
+				"name": name,
+			},
+		}),
+	}
+}
+
+// fetch de-duplicates keys against in-flight requests before calling backend
+// for whichever keys aren't already being fetched. found/bufs preserve the
+// order of keys, as Memcached.Fetch requires.
+func (g *singleFlightGroup) fetch(ctx context.Context, keys []string, backend fetchFunc) (found []string, bufs [][]byte, missed []string, err error) {
+	owned := make([]string, 0, len(keys))
+	ownedEntries := make([]*inflight, 0, len(keys))
+	waiting := make(map[string]*inflight, len(keys))
+
+	g.mu.Lock()
+	for _, key := range keys {
+		if e, ok := g.entries[key]; ok {
+			waiting[key] = e
+			continue
+		}
+		e := &inflight{id: g.nextID, done: make(chan struct{})}
+		g.nextID++
+		g.entries[key] = e
+		owned = append(owned, key)
+		ownedEntries = append(ownedEntries, e)
+	}
+	g.mu.Unlock()
+
+	if len(waiting) > 0 {
+		g.coalesced.Add(float64(len(waiting)))
+	}
+
+	results := make(map[string][]byte, len(keys))
+
+	if len(owned) > 0 {
+		var ownedFound, ownedMissed []string
+		var ownedBufs [][]byte
+		// This single backend call serves every caller coalesced onto
+		// owned, not just the one that happened to win ownership, so it
+		// must not be cancelled just because the owner's own ctx is: that
+		// would surface a spurious error to unrelated, healthy waiters.
+		// context.WithoutCancel keeps ctx's values without propagating its
+		// cancellation.
+		ownedFound, ownedBufs, ownedMissed, err = backend(context.WithoutCancel(ctx), owned)
+		_ = ownedMissed
+
+		for i, key := range ownedFound {
+			results[key] = ownedBufs[i]
+		}
+
+		g.mu.Lock()
+		for i, key := range owned {
+			e := ownedEntries[i]
+			if buf, ok := results[key]; ok {
+				e.buf = buf
+				e.found = true
+			}
+			e.err = err
+			// Only remove the entry we registered, comparing ids so that a
+			// newer generation under the same key would be left alone.
+			// Entries are removed only here, by their owner, so the entry
+			// found is e itself.
+			if cur, ok := g.entries[key]; ok && cur.id == e.id {
+				delete(g.entries, key)
+			}
+			close(e.done)
+		}
+		g.mu.Unlock()
+	}
+
+	for key, e := range waiting {
+		select {
+		case <-e.done:
+			if e.found {
+				results[key] = e.buf
+			}
+			if e.err != nil {
+				err = e.err
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	for _, key := range keys {
+		if buf, ok := results[key]; ok {
+			found = append(found, key)
+			bufs = append(bufs, buf)
+		} else {
+			missed = append(missed, key)
+		}
+	}
+
+	return
+}
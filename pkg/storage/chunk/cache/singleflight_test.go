@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSingleFlightGroup_CoalescesConcurrentFetches(t *testing.T) {
+	g := newSingleFlightGroup("test", prometheus.NewRegistry())
+
+	var callCount int
+	var mu sync.Mutex
+	release := make(chan struct{})
+
+	backend := func(_ context.Context, keys []string) ([]string, [][]byte, []string, error) {
+		mu.Lock()
+		callCount++
+		mu.Unlock()
+
+		<-release
+
+		bufs := make([][]byte, len(keys))
+		for i := range keys {
+			bufs[i] = []byte("value")
+		}
+		return keys, bufs, nil, nil
+	}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			found, bufs, _, err := g.fetch(context.Background(), []string{"a"}, backend)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if len(found) != 1 || len(bufs) != 1 {
+				t.Errorf("expected key to be found, got found=%v bufs=%v", found, bufs)
+			}
+		}()
+	}
+
+	// Wait until every other caller has coalesced onto the first caller's
+	// in-flight entry before letting the backend return, so they overlap.
+	for testutil.ToFloat64(g.coalesced) != callers-1 {
+		runtime.Gosched()
+	}
+
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if callCount != 1 {
+		t.Fatalf("expected exactly 1 backend call, got %d", callCount)
+	}
+}
+
+// TestSingleFlightGroup_WaiterSurvivesOwnerCancellation exercises a waiter
+// coalesced onto another caller's in-flight request: cancelling the owner's
+// context must not fail the waiter, since the backend call serves both and
+// the waiter's own context is perfectly healthy.
+func TestSingleFlightGroup_WaiterSurvivesOwnerCancellation(t *testing.T) {
+	g := newSingleFlightGroup("test", prometheus.NewRegistry())
+
+	release := make(chan struct{})
+	backend := func(ctx context.Context, keys []string) ([]string, [][]byte, []string, error) {
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		bufs := make([][]byte, len(keys))
+		for i := range keys {
+			bufs[i] = []byte("value")
+		}
+		return keys, bufs, nil, nil
+	}
+
+	ownerCtx, cancelOwner := context.WithCancel(context.Background())
+
+	var ownerWG sync.WaitGroup
+	ownerWG.Add(1)
+	go func() {
+		defer ownerWG.Done()
+		_, _, _, _ = g.fetch(ownerCtx, []string{"a"}, backend)
+	}()
+
+	// Wait for the owner to register its entry before sending in a waiter
+	// on the same key.
+	for {
+		g.mu.Lock()
+		n := len(g.entries)
+		g.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	var found []string
+	var bufs [][]byte
+	var err error
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		found, bufs, _, err = g.fetch(context.Background(), []string{"a"}, backend)
+	}()
+
+	// Wait for the waiter to coalesce onto the owner's entry before
+	// cancelling the owner and letting the backend return.
+	for testutil.ToFloat64(g.coalesced) != 1 {
+		runtime.Gosched()
+	}
+
+	cancelOwner()
+	close(release)
+
+	<-waiterDone
+	ownerWG.Wait()
+
+	if err != nil {
+		t.Fatalf("unexpected error for a waiter with a healthy context: %v", err)
+	}
+	if len(found) != 1 || len(bufs) != 1 {
+		t.Fatalf("expected key to be found, got found=%v bufs=%v", found, bufs)
+	}
+}